@@ -0,0 +1,66 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package net
+
+import (
+	"math/rand"
+	"time"
+)
+
+// probeBackoff tracks the adaptive interval between probe cycles for a
+// single revisionWatcher: it starts at floor, doubles on consecutive no-op
+// probe cycles up to ceiling, and resets to floor the instant a cycle
+// reports a changed dest set or an error, so churn is caught quickly while
+// steady-state probing stays cheap.
+type probeBackoff struct {
+	floor   time.Duration
+	ceiling time.Duration
+	jitter  float64
+	current time.Duration
+}
+
+func newProbeBackoff(floor, ceiling time.Duration, jitter float64) *probeBackoff {
+	return &probeBackoff{
+		floor:   floor,
+		ceiling: ceiling,
+		jitter:  jitter,
+		current: floor,
+	}
+}
+
+// nextInterval advances the backoff based on the outcome of the last probe
+// cycle and returns the (jittered) interval to wait before the next one.
+func (b *probeBackoff) nextInterval(changed bool, err error) time.Duration {
+	if changed || err != nil {
+		b.current = b.floor
+	} else if next := b.current * 2; next <= b.ceiling {
+		b.current = next
+	} else {
+		b.current = b.ceiling
+	}
+	return jittered(b.current, b.jitter)
+}
+
+// jittered returns d adjusted by up to ±jitter fraction, so many watchers
+// ticking at the same nominal interval don't synchronize their probes.
+func jittered(d time.Duration, jitter float64) time.Duration {
+	if jitter <= 0 {
+		return d
+	}
+	delta := (rand.Float64()*2 - 1) * jitter
+	return time.Duration(float64(d) * (1 + delta))
+}
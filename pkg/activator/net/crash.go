@@ -0,0 +1,58 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package net
+
+import (
+	"context"
+
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.uber.org/zap"
+)
+
+var watcherPanicsCount = stats.Int64(
+	"revision_watcher_panics_total",
+	"Number of panics recovered from a revisionBackendsManager goroutine",
+	stats.UnitDimensionless)
+
+func init() {
+	if err := view.Register(&view.View{
+		Description: watcherPanicsCount.Description(),
+		Measure:     watcherPanicsCount,
+		Aggregation: view.Count(),
+	}); err != nil {
+		panic(err)
+	}
+}
+
+// handleCrash recovers a panic in the calling goroutine, logging it and
+// recording a metric before invoking onCrash (e.g. to respawn a watcher).
+// It mirrors the "defer util.HandleCrash()" idiom kube's controllers use in
+// every long-running worker: a bug inside probe, getK8sPrivateService, or a
+// downstream lister call should degrade a single revisionWatcher, not bring
+// down the activator process. Must be called via defer.
+func handleCrash(logger *zap.SugaredLogger, component string, onCrash func(r interface{})) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	logger.Errorw("Recovered from panic in "+component, zap.Any("panic", r))
+	stats.Record(context.Background(), watcherPanicsCount.M(1))
+	if onCrash != nil {
+		onCrash(r)
+	}
+}
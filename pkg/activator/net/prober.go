@@ -0,0 +1,209 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package net
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+
+	"knative.dev/serving/pkg/apis/networking"
+	"knative.dev/serving/pkg/network"
+	"knative.dev/serving/pkg/network/prober"
+	"knative.dev/serving/pkg/queue"
+)
+
+// GRPCHealthCheckAnnotation opts a revision into gRPC health-checking of its
+// pods/ClusterIP instead of the default HTTP knative-probe. gRPC revisions
+// are still served over ProtocolH2C or ProtocolHTTP1, so this can't be
+// expressed as a networking.ProtocolType and needs its own annotation.
+const GRPCHealthCheckAnnotation = "networking.knative.dev/grpc-health-check"
+
+// protocolGRPC is not a networking.ProtocolType a revision can declare; it's
+// used purely as a lookup key into a Prober map for revisions carrying
+// GRPCHealthCheckAnnotation.
+const protocolGRPC networking.ProtocolType = "grpc"
+
+// Prober probes a single l4 dest for the given protocol and reports whether
+// it is currently healthy.
+type Prober interface {
+	Probe(ctx context.Context, dest string, proto networking.ProtocolType) (bool, error)
+}
+
+// httpProber is the default Prober. It issues the knative-probe HTTP GET
+// that queue-proxy answers, asserting the queue.Name body so we know we
+// reached a queue-proxy and not some other listener on the same port.
+type httpProber struct {
+	transport http.RoundTripper
+}
+
+func (p *httpProber) Probe(ctx context.Context, dest string, proto networking.ProtocolType) (bool, error) {
+	httpDest := url.URL{
+		Scheme: "http",
+		Host:   dest,
+	}
+	// NOTE: changes below may require changes to testing/roundtripper.go to make unit tests passing.
+	return prober.Do(ctx, p.transport, httpDest.String(),
+		prober.WithHeader(network.ProbeHeaderName, queue.Name),
+		prober.WithHeader(network.UserAgentKey, network.ActivatorUserAgent),
+		prober.ExpectsBody(queue.Name),
+		prober.ExpectsStatusCodes([]int{http.StatusOK}))
+}
+
+// tcpProber is used for revisions where queue-proxy is bypassed or absent
+// (e.g. raw TCP workloads) and all we can assert is that something accepts
+// connections on the dest.
+type tcpProber struct {
+	dialer net.Dialer
+}
+
+func (p *tcpProber) Probe(ctx context.Context, dest string, proto networking.ProtocolType) (bool, error) {
+	conn, err := p.dialer.DialContext(ctx, "tcp", dest)
+	if err != nil {
+		return false, err
+	}
+	conn.Close()
+	return true, nil
+}
+
+// grpcConnReapInterval is how often grpcProber sweeps its connection cache
+// for dests whose ClientConn has gone bad, so a dest that's never probed
+// again (e.g. its pod was recycled) doesn't leak a connection stuck
+// retrying forever.
+const grpcConnReapInterval = time.Minute
+
+// grpcProber health-checks a dest via the standard grpc.health.v1.Health
+// service, for revisions carrying GRPCHealthCheckAnnotation. Dialing and
+// the HTTP/2 connection handshake are comparatively expensive, so it caches one
+// ClientConn per dest and reuses it across probes instead of dialing fresh
+// every cycle.
+type grpcProber struct {
+	mu    sync.Mutex
+	conns map[string]*grpc.ClientConn
+}
+
+func newGRPCProber(stopCh <-chan struct{}) *grpcProber {
+	p := &grpcProber{conns: make(map[string]*grpc.ClientConn)}
+	go p.reapLoop(stopCh)
+	return p
+}
+
+// connFor returns the cached ClientConn for dest, dialing (and caching) one
+// if there isn't a usable connection yet.
+func (p *grpcProber) connFor(ctx context.Context, dest string) (*grpc.ClientConn, error) {
+	p.mu.Lock()
+	if conn, ok := p.conns[dest]; ok {
+		if state := conn.GetState(); state != connectivity.TransientFailure && state != connectivity.Shutdown {
+			p.mu.Unlock()
+			return conn, nil
+		}
+		delete(p.conns, dest)
+		p.mu.Unlock()
+		conn.Close()
+	} else {
+		p.mu.Unlock()
+	}
+
+	// Dial outside the lock: with grpc.WithBlock() this can take up to the
+	// probe timeout, and we don't want to stall probes to other dests.
+	conn, err := grpc.DialContext(ctx, dest, grpc.WithInsecure(), grpc.WithBlock())
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial %s for grpc health check: %w", dest, err)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if existing, ok := p.conns[dest]; ok {
+		// Lost a race with another probe of the same dest; keep theirs.
+		conn.Close()
+		return existing, nil
+	}
+	p.conns[dest] = conn
+	return conn, nil
+}
+
+// reapLoop periodically drops cached connections that have gone bad, until
+// stopCh is closed, at which point it closes every remaining cached
+// connection so none outlive the revisionBackendsManager that owns it.
+func (p *grpcProber) reapLoop(stopCh <-chan struct{}) {
+	ticker := time.NewTicker(grpcConnReapInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.reapDead()
+		case <-stopCh:
+			p.closeAll()
+			return
+		}
+	}
+}
+
+func (p *grpcProber) reapDead() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for dest, conn := range p.conns {
+		switch conn.GetState() {
+		case connectivity.TransientFailure, connectivity.Shutdown:
+			conn.Close()
+			delete(p.conns, dest)
+		}
+	}
+}
+
+func (p *grpcProber) closeAll() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for dest, conn := range p.conns {
+		conn.Close()
+		delete(p.conns, dest)
+	}
+}
+
+func (p *grpcProber) Probe(ctx context.Context, dest string, proto networking.ProtocolType) (bool, error) {
+	conn, err := p.connFor(ctx, dest)
+	if err != nil {
+		return false, err
+	}
+
+	resp, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{})
+	if err != nil {
+		return false, err
+	}
+	return resp.Status == healthpb.HealthCheckResponse_SERVING, nil
+}
+
+// defaultProbers returns the built-in Prober strategy for each protocol
+// revisionBackendsManager knows how to health-check out of the box. stopCh
+// bounds the lifetime of any background goroutines a Prober starts (e.g.
+// grpcProber's connection reaper) to that of the owning
+// revisionBackendsManager.
+func defaultProbers(tr http.RoundTripper, stopCh <-chan struct{}) map[networking.ProtocolType]Prober {
+	return map[networking.ProtocolType]Prober{
+		networking.ProtocolHTTP1: &httpProber{transport: tr},
+		networking.ProtocolH2C:   &tcpProber{},
+		protocolGRPC:             newGRPCProber(stopCh),
+	}
+}
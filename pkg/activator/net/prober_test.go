@@ -0,0 +1,166 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package net
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+
+	"knative.dev/serving/pkg/apis/networking"
+)
+
+func TestProberForSelection(t *testing.T) {
+	httpP := &fakeProber{healthy: nil}
+	grpcP := &fakeProber{healthy: nil}
+	rbm := &revisionBackendsManager{
+		probers: map[networking.ProtocolType]Prober{
+			networking.ProtocolHTTP1: httpP,
+			protocolGRPC:             grpcP,
+		},
+	}
+
+	if got := rbm.proberFor(networking.ProtocolHTTP1, nil); got != httpP {
+		t.Error("expected ProtocolHTTP1 with no annotations to pick the HTTP1 prober")
+	}
+
+	// No Prober registered for H2C in this map; must fall back to HTTP1.
+	if got := rbm.proberFor(networking.ProtocolH2C, nil); got != httpP {
+		t.Error("expected unregistered protocol to fall back to the HTTP1 prober")
+	}
+
+	annotations := map[string]string{GRPCHealthCheckAnnotation: "true"}
+	if got := rbm.proberFor(networking.ProtocolHTTP1, annotations); got != grpcP {
+		t.Error("expected GRPCHealthCheckAnnotation to override protocol-based dispatch")
+	}
+
+	// GRPCHealthCheckAnnotation set but no gRPC prober registered: fall back
+	// to normal protocol dispatch rather than picking nothing.
+	rbm.probers = map[networking.ProtocolType]Prober{networking.ProtocolHTTP1: httpP}
+	if got := rbm.proberFor(networking.ProtocolHTTP1, annotations); got != httpP {
+		t.Error("expected fallback to protocol dispatch when no gRPC prober is registered")
+	}
+}
+
+func TestTCPProberProbe(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() = %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	p := &tcpProber{}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	ok, err := p.Probe(ctx, ln.Addr().String(), networking.ProtocolH2C)
+	if err != nil || !ok {
+		t.Fatalf("Probe(listening addr) = %v, %v; want true, nil", ok, err)
+	}
+
+	// Nothing listens here: the dialer should fail rather than report healthy.
+	deadLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() = %v", err)
+	}
+	deadAddr := deadLn.Addr().String()
+	deadLn.Close()
+
+	if ok, err := p.Probe(ctx, deadAddr, networking.ProtocolH2C); err == nil || ok {
+		t.Fatalf("Probe(closed addr) = %v, %v; want false, non-nil error", ok, err)
+	}
+}
+
+// newTestGRPCHealthServer starts a gRPC server reporting the overall (empty
+// service name) health as SERVING and returns its listen address and a
+// cleanup func.
+func newTestGRPCHealthServer(t *testing.T) (addr string, stop func()) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() = %v", err)
+	}
+
+	hs := health.NewServer()
+	hs.SetServingStatus("", healthpb.HealthCheckResponse_SERVING)
+
+	srv := grpc.NewServer()
+	healthpb.RegisterHealthServer(srv, hs)
+
+	go srv.Serve(ln)
+	return ln.Addr().String(), srv.Stop
+}
+
+func TestGRPCProberCachesConnectionAndRedialsAfterClose(t *testing.T) {
+	addr, stop := newTestGRPCHealthServer(t)
+	defer stop()
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	p := newGRPCProber(stopCh)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	ok, err := p.Probe(ctx, addr, protocolGRPC)
+	if err != nil || !ok {
+		t.Fatalf("first Probe() = %v, %v; want true, nil", ok, err)
+	}
+	p.mu.Lock()
+	firstConn, ok := p.conns[addr]
+	p.mu.Unlock()
+	if !ok {
+		t.Fatal("expected a cached ClientConn after a successful probe")
+	}
+
+	if ok, err := p.Probe(ctx, addr, protocolGRPC); err != nil || !ok {
+		t.Fatalf("second Probe() = %v, %v; want true, nil", ok, err)
+	}
+	p.mu.Lock()
+	secondConn := p.conns[addr]
+	p.mu.Unlock()
+	if secondConn != firstConn {
+		t.Error("expected the second Probe() to reuse the cached ClientConn instead of redialing")
+	}
+
+	// Simulate the cached connection going bad: connFor should notice,
+	// drop it, and dial a fresh one rather than reusing or failing forever.
+	firstConn.Close()
+	if ok, err := p.Probe(ctx, addr, protocolGRPC); err != nil || !ok {
+		t.Fatalf("Probe() after forcing the cached conn closed = %v, %v; want true, nil", ok, err)
+	}
+	p.mu.Lock()
+	thirdConn := p.conns[addr]
+	p.mu.Unlock()
+	if thirdConn == firstConn {
+		t.Error("expected a closed cached ClientConn to be replaced by a fresh dial")
+	}
+}
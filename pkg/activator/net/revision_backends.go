@@ -21,7 +21,7 @@ import (
 	"fmt"
 	"net"
 	"net/http"
-	"net/url"
+	"runtime"
 	"strconv"
 	"sync"
 	"time"
@@ -33,8 +33,10 @@ import (
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/wait"
 	corev1listers "k8s.io/client-go/listers/core/v1"
 	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
 
 	endpointsinformer "knative.dev/pkg/client/injection/kube/informers/core/v1/endpoints"
 	serviceinformer "knative.dev/pkg/client/injection/kube/informers/core/v1/service"
@@ -44,16 +46,16 @@ import (
 	"knative.dev/serving/pkg/apis/serving"
 	revisioninformer "knative.dev/serving/pkg/client/injection/informers/serving/v1alpha1/revision"
 	servinglisters "knative.dev/serving/pkg/client/listers/serving/v1alpha1"
-	"knative.dev/serving/pkg/network"
-	"knative.dev/serving/pkg/network/prober"
-	"knative.dev/serving/pkg/queue"
 	"knative.dev/serving/pkg/reconciler"
 )
 
 // revisionDestsUpdate contains the state of healthy l4 dests for talking to a revision and is the
-// primary output from the RevisionBackendsManager system. If a healthy ClusterIP is found then
-// ClusterIPDest will be set to non empty string and Dests will be nil. Otherwise Dests will be set
-// to a slice of healthy l4 dests for reaching the revision.
+// primary output from the RevisionBackendsManager system. ClusterIPDest is set to a non empty
+// string once the ClusterIP has been successfully probed; Dests, the set of individually-probed
+// healthy pod IPs, keeps being populated alongside it rather than going nil, so callers can fall
+// back to per-pod dests if the ClusterIP's view of the world turns out to be stale. Before the
+// ClusterIP is healthy, ClusterIPDest is empty and Dests alone carries the healthy pod IPs.
+// Callers that assumed ClusterIPDest set implies Dests nil need to be updated for this.
 type revisionDestsUpdate struct {
 	Rev           types.NamespacedName
 	ClusterIPDest string
@@ -61,8 +63,28 @@ type revisionDestsUpdate struct {
 }
 
 const (
-	probeTimeout   time.Duration = 300 * time.Millisecond
+	probeTimeout time.Duration = 300 * time.Millisecond
+	// probeFrequency is the floor of the adaptive probe backoff: the interval
+	// used after a probe cycle that saw the dests change or hit an error.
 	probeFrequency time.Duration = 200 * time.Millisecond
+	// probeFrequencyCeiling is the interval backoff climbs to after
+	// consecutive no-op probe cycles (no change, no error), even while the
+	// revision is still unhealthy. Once the ClusterIP is healthy, run stops
+	// ticking and only probes on dests updates.
+	probeFrequencyCeiling time.Duration = 5 * time.Second
+	// probeFrequencyJitter is the ± fraction applied to the backoff interval
+	// so revisions activated together don't synchronize their probes.
+	probeFrequencyJitter float64 = 0.2
+
+	// respawnBackoffFloor/Ceiling bound the delay runRevisionWatcher waits
+	// before respawning a revisionWatcher that panicked, so a deterministic
+	// panic degrades into a slow retry loop instead of a tight crash loop.
+	respawnBackoffFloor   time.Duration = 100 * time.Millisecond
+	respawnBackoffCeiling time.Duration = 30 * time.Second
+	// respawnHealthyResetAfter is how long a watcher has to run without
+	// panicking before a subsequent crash is treated as a fresh attempt #1
+	// rather than a continuation of the prior backoff chain.
+	respawnHealthyResetAfter time.Duration = time.Minute
 )
 
 // revisionWatcher watches the podIPs and ClusterIP of the service for a revision. It implements the logic
@@ -78,17 +100,38 @@ type revisionWatcher struct {
 	healthyPods sets.String
 	// Stores whether the service ClusterIP has been seen as healthy
 	clusterIPHealthy bool
+	// Stores the last set of dests we saw from the endpoints informer, so we
+	// can detect pod churn even after the ClusterIP is marked healthy.
+	lastDests sets.String
 
-	transport     http.RoundTripper
+	prober        Prober
 	destsCh       chan sets.String
 	serviceLister corev1listers.ServiceLister
 	logger        *zap.SugaredLogger
+
+	// stopped is closed when run() returns (for any reason, including a
+	// panic's unwind). Unlike destsCh, which callers send dests into, this
+	// is ours to close: it's how a sender on destsCh (syncRevisionEndpoints)
+	// detects that nobody will ever read what it's about to send, without
+	// racing the close of destsCh itself. See syncRevisionEndpoints.
+	stopped chan struct{}
+
+	// probeFloor/probeCeiling/probeJitter parameterize the adaptive backoff
+	// used by run to space out probe cycles.
+	probeFloor   time.Duration
+	probeCeiling time.Duration
+	probeJitter  float64
+
+	// spawnedAt and respawnAttempt are used by respawnRevisionWatcher to back
+	// off respawns after a panic; see its doc comment.
+	spawnedAt      time.Time
+	respawnAttempt int
 }
 
 func newRevisionWatcher(ctx context.Context, rev types.NamespacedName, protocol networking.ProtocolType,
 	updateCh chan<- revisionDestsUpdate, destsCh chan sets.String,
-	transport http.RoundTripper, serviceLister corev1listers.ServiceLister,
-	logger *zap.SugaredLogger) *revisionWatcher {
+	prober Prober, serviceLister corev1listers.ServiceLister,
+	logger *zap.SugaredLogger, probeFloor, probeCeiling time.Duration, probeJitter float64) *revisionWatcher {
 	ctx, cancel := context.WithCancel(ctx)
 	return &revisionWatcher{
 		doneCh:        ctx.Done(),
@@ -97,10 +140,15 @@ func newRevisionWatcher(ctx context.Context, rev types.NamespacedName, protocol
 		protocol:      protocol,
 		updateCh:      updateCh,
 		healthyPods:   sets.NewString(),
-		transport:     transport,
+		prober:        prober,
 		destsCh:       destsCh,
 		serviceLister: serviceLister,
 		logger:        logger,
+		stopped:       make(chan struct{}),
+		probeFloor:    probeFloor,
+		probeCeiling:  probeCeiling,
+		probeJitter:   probeJitter,
+		spawnedAt:     time.Now(),
 	}
 }
 
@@ -125,17 +173,7 @@ func (rw *revisionWatcher) getK8sPrivateService() (*corev1.Service, error) {
 }
 
 func (rw *revisionWatcher) probe(ctx context.Context, dest string) (bool, error) {
-	httpDest := url.URL{
-		Scheme: "http",
-		Host:   dest,
-	}
-	// NOTE: changes below may require changes to testing/roundtripper.go to make unit tests passing.
-	return prober.Do(ctx, rw.transport, httpDest.String(),
-		prober.WithHeader(network.ProbeHeaderName, queue.Name),
-		prober.WithHeader(network.UserAgentKey, network.ActivatorUserAgent),
-		prober.ExpectsBody(queue.Name),
-		prober.ExpectsStatusCodes([]int{http.StatusOK}))
-
+	return rw.prober.Probe(ctx, dest, rw.protocol)
 }
 
 func (rw *revisionWatcher) getDest() (string, error) {
@@ -221,61 +259,85 @@ func (rw *revisionWatcher) sendUpdate(clusterIP string, dests sets.String) {
 }
 
 // checkDests performs probing and potentially sends a dests update. It is
-// assumed this method is not called concurrently.
-func (rw *revisionWatcher) checkDests(dests sets.String) {
+// assumed this method is not called concurrently. It reports whether the
+// observed dests/health changed and any error encountered, so run can feed
+// its probe backoff.
+func (rw *revisionWatcher) checkDests(dests sets.String) (changed bool, err error) {
 	if len(dests) == 0 {
 		// We must have scaled down.
 		rw.clusterIPHealthy = false
+		rw.healthyPods = nil
+		rw.lastDests = nil
 		rw.logger.Debug("ClusterIP is no longer healthy.")
 		// Send update that we are now inactive (both params invalid).
 		rw.sendUpdate("", nil)
-		return
+		return true, nil
 	}
 
+	// Endpoints churn (pods rolled/scaled) invalidates any pod IPs we've
+	// already probed, even if the ClusterIP itself is still healthy: the
+	// dispatcher/queue-proxy behind it may not have caught up yet.
+	podsChanged := !rw.lastDests.Equal(dests)
+	rw.lastDests = dests
+
 	// First check the clusterIP. We can't cache it, since user might go rogue
 	// and delete the K8s service. We'll fix it, but the cluster IP will be different.
 	dest, err := rw.getDest()
 	if err != nil {
 		rw.logger.Errorw("Failed to determine service destination", zap.Error(err))
-		return
+		return false, err
 	}
 
-	if rw.clusterIPHealthy {
-		// cluster IP is healthy and we haven't scaled down, short circuit.
+	if rw.clusterIPHealthy && !podsChanged {
+		// cluster IP is healthy and the backing pods haven't changed, short circuit.
 		rw.logger.Debugf("ClusterIP %s already probed (backends: %d)", dest, len(dests))
-		rw.sendUpdate(dest, dests)
-		return
+		rw.sendUpdate(dest, rw.healthyPods)
+		return false, nil
 	}
 
 	// If clusterIP is healthy send this update and we are done.
-	if ok, err := rw.probeClusterIP(dest); err != nil {
-		rw.logger.Errorw("Failed to probe clusterIP "+dest, zap.Error(err))
+	if ok, probeErr := rw.probeClusterIP(dest); probeErr != nil {
+		rw.logger.Errorw("Failed to probe clusterIP "+dest, zap.Error(probeErr))
+		err = probeErr
 	} else if ok {
 		rw.logger.Debugf("ClusterIP is successfully probed: %s (backends: %d)", dest, len(dests))
 		rw.clusterIPHealthy = true
-		rw.healthyPods = nil
-		rw.sendUpdate(dest, dests)
-		return
 	}
 
-	hs, noop, err := rw.probePodIPs(dests)
-	if err != nil {
-		rw.logger.Errorw("Failed probing", zap.Error(err))
+	// Keep probing pod IPs even once the ClusterIP is healthy so callers can
+	// fall back to per-pod dests if the service's view of the world is stale.
+	hs, noop, probeErr := rw.probePodIPs(dests)
+	if probeErr != nil {
+		rw.logger.Errorw("Failed probing", zap.Error(probeErr))
 		// We dont want to return here as an error still affects health states.
+		err = probeErr
 	}
 
 	rw.logger.Debugf("Done probing, got %d healthy pods", len(hs))
-	if !noop {
+	if !noop || podsChanged {
 		rw.healthyPods = hs
-		rw.sendUpdate("" /*clusterIP not ready yet*/, hs)
+		changed = true
+	}
+
+	if rw.clusterIPHealthy {
+		rw.sendUpdate(dest, rw.healthyPods)
+	} else if !noop {
+		rw.sendUpdate("" /*clusterIP not ready yet*/, rw.healthyPods)
 	}
+
+	return changed, err
 }
 
-func (rw *revisionWatcher) run(probeFrequency time.Duration) {
-	defer close(rw.destsCh)
+func (rw *revisionWatcher) run() {
+	// NOTE: destsCh itself is never closed here. It's owned by whoever sends
+	// into it (syncRevisionEndpoints/respawnRevisionWatcher); closing it on
+	// our way out would let a concurrent send race a close and panic. stopped
+	// is ours to close, and is what senders select on instead.
+	defer close(rw.stopped)
 
 	var dests sets.String
-	timer := time.NewTicker(probeFrequency)
+	backoff := newProbeBackoff(rw.probeFloor, rw.probeCeiling, rw.probeJitter)
+	timer := time.NewTimer(rw.probeFloor)
 	defer timer.Stop()
 
 	var tickCh <-chan time.Time
@@ -294,7 +356,20 @@ func (rw *revisionWatcher) run(probeFrequency time.Duration) {
 		case <-tickCh:
 		}
 
-		rw.checkDests(dests)
+		changed, err := rw.checkDests(dests)
+
+		// timer may already have fired (e.g. we looped back around via the
+		// destsCh branch instead of tickCh) without anything draining
+		// timer.C; Reset is only safe to call on a stopped-and-drained
+		// timer, or the stale fire would make the very next iteration's
+		// tickCh ready immediately, skipping the backoff we just computed.
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(backoff.nextInterval(changed, err))
 	}
 }
 
@@ -308,30 +383,60 @@ type revisionBackendsManager struct {
 	revisionWatchers    map[types.NamespacedName]*revisionWatcher
 	revisionWatchersMux sync.RWMutex
 
-	updateCh       chan revisionDestsUpdate
-	transport      http.RoundTripper
-	logger         *zap.SugaredLogger
-	probeFrequency time.Duration
+	// workqueue decouples the informer's dispatch goroutine from the
+	// potentially slow getOrCreateRevisionWatcher/probe path: a stall on one
+	// revision no longer head-of-line blocks updates for every other one.
+	// It also gives us free deduplication of rapid endpoint updates.
+	workqueue workqueue.RateLimitingInterface
+	// latestEndpoints caches, per revision, the most recent Endpoints object
+	// observed by the informer, so workers can compute dests without
+	// re-listing. A missing entry means the endpoints were deleted.
+	latestEndpoints    map[types.NamespacedName]*corev1.Endpoints
+	latestEndpointsMux sync.Mutex
+
+	updateCh chan revisionDestsUpdate
+	probers  map[networking.ProtocolType]Prober
+	logger   *zap.SugaredLogger
+
+	// probeFloor/probeCeiling/probeJitter parameterize the adaptive backoff
+	// handed to every revisionWatcher it spawns.
+	probeFloor   time.Duration
+	probeCeiling time.Duration
+	probeJitter  float64
 }
 
 // NewRevisionBackendsManager returns a new RevisionBackendsManager with default
 // probe time out.
 func newRevisionBackendsManager(ctx context.Context, tr http.RoundTripper) *revisionBackendsManager {
-	return newRevisionBackendsManagerWithProbeFrequency(ctx, tr, probeFrequency)
+	return newRevisionBackendsManagerWithProbeFrequency(ctx, tr, probeFrequency, probeFrequencyCeiling, probeFrequencyJitter)
 }
 
-// newRevisionBackendsManagerWithProbeFrequency creates a fully spec'd RevisionBackendsManager.
+// newRevisionBackendsManagerWithProbeFrequency creates a fully spec'd RevisionBackendsManager
+// using the default Prober strategies. floor/ceiling/jitter tune the adaptive probe backoff
+// (see probeBackoff).
 func newRevisionBackendsManagerWithProbeFrequency(ctx context.Context, tr http.RoundTripper,
-	probeFreq time.Duration) *revisionBackendsManager {
+	floor, ceiling time.Duration, jitter float64) *revisionBackendsManager {
+	return newRevisionBackendsManagerWithProbers(ctx, tr, floor, ceiling, jitter, defaultProbers(tr, ctx.Done()))
+}
+
+// newRevisionBackendsManagerWithProbers creates a fully spec'd RevisionBackendsManager,
+// allowing the per-protocol Prober strategies to be swapped out (e.g. for testing).
+func newRevisionBackendsManagerWithProbers(ctx context.Context, tr http.RoundTripper,
+	floor, ceiling time.Duration, jitter float64, probers map[networking.ProtocolType]Prober) *revisionBackendsManager {
 	rbm := &revisionBackendsManager{
 		ctx:              ctx,
 		revisionLister:   revisioninformer.Get(ctx).Lister(),
 		serviceLister:    serviceinformer.Get(ctx).Lister(),
 		revisionWatchers: make(map[types.NamespacedName]*revisionWatcher),
-		updateCh:         make(chan revisionDestsUpdate),
-		transport:        tr,
-		logger:           logging.FromContext(ctx),
-		probeFrequency:   probeFrequency,
+		workqueue: workqueue.NewNamedRateLimitingQueue(
+			workqueue.DefaultControllerRateLimiter(), "revisionEndpoints"),
+		latestEndpoints: make(map[types.NamespacedName]*corev1.Endpoints),
+		updateCh:        make(chan revisionDestsUpdate),
+		probers:         probers,
+		logger:          logging.FromContext(ctx),
+		probeFloor:      floor,
+		probeCeiling:    ceiling,
+		probeJitter:     jitter,
 	}
 	endpointsInformer := endpointsinformer.Get(ctx)
 	endpointsInformer.Informer().AddEventHandler(cache.FilteringResourceEventHandler{
@@ -349,6 +454,8 @@ func newRevisionBackendsManagerWithProbeFrequency(ctx context.Context, tr http.R
 	})
 
 	go func() {
+		defer handleCrash(rbm.logger, "revisionBackendsManager cleanup", nil)
+
 		// updateCh can only be closed after revisionWatchers are done running
 		defer close(rbm.updateCh)
 
@@ -359,7 +466,7 @@ func newRevisionBackendsManagerWithProbeFrequency(ctx context.Context, tr http.R
 		rbm.revisionWatchersMux.Lock()
 		defer rbm.revisionWatchersMux.Unlock()
 		for _, rw := range rbm.revisionWatchers {
-			<-rw.destsCh
+			<-rw.stopped
 		}
 	}()
 
@@ -371,38 +478,132 @@ func (rbm *revisionBackendsManager) updates() <-chan revisionDestsUpdate {
 	return rbm.updateCh
 }
 
-func (rbm *revisionBackendsManager) getRevisionProtocol(revID types.NamespacedName) (networking.ProtocolType, error) {
-	revision, err := rbm.revisionLister.Revisions(revID.Namespace).Get(revID.Name)
-	if err != nil {
-		return "", err
+// proberFor picks the Prober strategy to use for a revision, preferring the
+// gRPC health-checker when the revision opts in via GRPCHealthCheckAnnotation
+// and otherwise dispatching on the revision's declared protocol.
+func (rbm *revisionBackendsManager) proberFor(proto networking.ProtocolType, annotations map[string]string) Prober {
+	if annotations[GRPCHealthCheckAnnotation] == "true" {
+		if p, ok := rbm.probers[protocolGRPC]; ok {
+			return p
+		}
+	}
+	if p, ok := rbm.probers[proto]; ok {
+		return p
 	}
-	return revision.GetProtocol(), nil
+	return rbm.probers[networking.ProtocolHTTP1]
 }
 
 func (rbm *revisionBackendsManager) getOrCreateRevisionWatcher(rev types.NamespacedName) (*revisionWatcher, error) {
+	// Fast path: the common case (watcher already exists) only needs a read
+	// lock, so the workqueue's parallel workers don't serialize on each
+	// other just to look a revision up.
+	rbm.revisionWatchersMux.RLock()
+	rw, ok := rbm.revisionWatchers[rev]
+	rbm.revisionWatchersMux.RUnlock()
+	if ok {
+		return rw, nil
+	}
+
 	rbm.revisionWatchersMux.Lock()
 	defer rbm.revisionWatchersMux.Unlock()
 
-	rwCh, ok := rbm.revisionWatchers[rev]
-	if !ok {
-		proto, err := rbm.getRevisionProtocol(rev)
-		if err != nil {
-			return nil, err
+	// Someone may have created it between the RUnlock above and this Lock.
+	if rw, ok := rbm.revisionWatchers[rev]; ok {
+		return rw, nil
+	}
+
+	revision, err := rbm.revisionLister.Revisions(rev.Namespace).Get(rev.Name)
+	if err != nil {
+		return nil, err
+	}
+	proto := revision.GetProtocol()
+	p := rbm.proberFor(proto, revision.Annotations)
+
+	destsCh := make(chan sets.String)
+	rw = newRevisionWatcher(rbm.ctx, rev, proto, rbm.updateCh, destsCh, p, rbm.serviceLister, rbm.logger,
+		rbm.probeFloor, rbm.probeCeiling, rbm.probeJitter)
+	rbm.revisionWatchers[rev] = rw
+	go rbm.runRevisionWatcher(rw)
+	return rw, nil
+}
+
+// runRevisionWatcher waits out rw's respawn backoff, if any, then runs
+// rw.run() under panic recovery: a bug inside probe, getK8sPrivateService,
+// or a downstream lister call degrades this single revisionWatcher instead
+// of taking down the activator process. On a panic it respawns a
+// replacement watcher for the same revision.
+func (rbm *revisionBackendsManager) runRevisionWatcher(rw *revisionWatcher) {
+	if rw.respawnAttempt > 0 {
+		select {
+		case <-time.After(respawnDelay(rw.respawnAttempt)):
+		case <-rw.doneCh:
+			// run never started, so close stopped here on its behalf.
+			close(rw.stopped)
+			return
 		}
+	}
 
-		destsCh := make(chan sets.String)
-		rw := newRevisionWatcher(rbm.ctx, rev, proto, rbm.updateCh, destsCh, rbm.transport, rbm.serviceLister, rbm.logger)
-		rbm.revisionWatchers[rev] = rw
-		go rw.run(rbm.probeFrequency)
-		return rw, nil
+	defer handleCrash(rbm.logger, "revisionWatcher "+rw.rev.String(), func(r interface{}) {
+		rbm.respawnRevisionWatcher(rw)
+	})
+	rw.run()
+}
+
+// respawnDelay returns the (jittered) delay to wait before a respawn
+// attempt, doubling with each consecutive attempt up to
+// respawnBackoffCeiling.
+func respawnDelay(attempt int) time.Duration {
+	d := respawnBackoffFloor
+	for i := 1; i < attempt && d < respawnBackoffCeiling; i++ {
+		d *= 2
+	}
+	if d > respawnBackoffCeiling {
+		d = respawnBackoffCeiling
+	}
+	return jittered(d, probeFrequencyJitter)
+}
+
+// respawnRevisionWatcher replaces a crashed revisionWatcher with a fresh one
+// for the same revision, seeded with its last known dests so the panic
+// doesn't cost a full probe cycle's worth of cold-start latency. The
+// replacement's startup is delayed by an exponential backoff (see
+// runRevisionWatcher/respawnDelay) so a watcher that panics deterministically
+// on every run degrades into a slow retry loop rather than a tight crash
+// loop; a watcher that had been running healthily for a while before it
+// crashed resets back to the first backoff step.
+func (rbm *revisionBackendsManager) respawnRevisionWatcher(crashed *revisionWatcher) {
+	rbm.revisionWatchersMux.Lock()
+	defer rbm.revisionWatchersMux.Unlock()
+
+	// The watcher may have already been deleted (e.g. revision scaled to
+	// zero and GC'd) or replaced out from under us; don't resurrect it.
+	if rbm.revisionWatchers[crashed.rev] != crashed {
+		return
+	}
+
+	attempt := crashed.respawnAttempt + 1
+	if time.Since(crashed.spawnedAt) >= respawnHealthyResetAfter {
+		attempt = 1
 	}
 
-	return rwCh, nil
+	destsCh := make(chan sets.String, 1)
+	if crashed.lastDests != nil {
+		destsCh <- crashed.lastDests
+	}
+	rw := newRevisionWatcher(rbm.ctx, crashed.rev, crashed.protocol, rbm.updateCh, destsCh,
+		crashed.prober, rbm.serviceLister, rbm.logger, rbm.probeFloor, rbm.probeCeiling, rbm.probeJitter)
+	rw.respawnAttempt = attempt
+	rbm.revisionWatchers[crashed.rev] = rw
+	go rbm.runRevisionWatcher(rw)
 }
 
 // endpointsUpdated is a handler function to be used by the Endpoints informer.
-// It updates the endpoints in the RevisionBackendsManager if the hosts changed
+// It stashes the latest Endpoints for the revision and enqueues a sync,
+// rather than driving the (potentially slow) revisionWatcher directly from
+// the informer's dispatch goroutine.
 func (rbm *revisionBackendsManager) endpointsUpdated(newObj interface{}) {
+	defer handleCrash(rbm.logger, "endpointsUpdated", nil)
+
 	// Ignore the updates when we've terminated.
 	select {
 	case <-rbm.ctx.Done():
@@ -413,14 +614,11 @@ func (rbm *revisionBackendsManager) endpointsUpdated(newObj interface{}) {
 	endpoints := newObj.(*corev1.Endpoints)
 	revID := types.NamespacedName{endpoints.Namespace, endpoints.Labels[serving.RevisionLabelKey]}
 
-	rw, err := rbm.getOrCreateRevisionWatcher(revID)
-	if err != nil {
-		rbm.logger.With(zap.Error(err)).Error("Failed to get revision watcher for revision %q", revID.String())
-		return
-	}
-	dests := endpointsToDests(endpoints, networking.ServicePortName(rw.protocol))
-	rbm.logger.Debugf("Updating Endpoints: %q (backends: %d)", revID.String(), len(dests))
-	rw.destsCh <- dests
+	rbm.latestEndpointsMux.Lock()
+	rbm.latestEndpoints[revID] = endpoints
+	rbm.latestEndpointsMux.Unlock()
+
+	rbm.workqueue.Add(revID)
 }
 
 // deleteRevisionWatcher deletes the revision watcher for rev if it exists. It expects
@@ -432,18 +630,139 @@ func (rbm *revisionBackendsManager) deleteRevisionWatcher(rev types.NamespacedNa
 	}
 }
 
+// endpointsDeleted is a handler function to be used by the Endpoints informer.
+// It drops the cached Endpoints for the revision and enqueues a sync; the
+// worker drains it against deleteRevisionWatcher once the cache miss is seen.
 func (rbm *revisionBackendsManager) endpointsDeleted(obj interface{}) {
+	defer handleCrash(rbm.logger, "endpointsDeleted", nil)
+
 	// Ignore the updates when we've terminated.
 	select {
 	case <-rbm.ctx.Done():
 		return
 	default:
 	}
-	ep := obj.(*corev1.Endpoints)
+	ep, ok := obj.(*corev1.Endpoints)
+	if !ok {
+		tombstone, ok := obj.(cache.DeletedFinalStateUnknown)
+		if !ok {
+			rbm.logger.Errorf("Couldn't get object from tombstone %#v", obj)
+			return
+		}
+		ep, ok = tombstone.Obj.(*corev1.Endpoints)
+		if !ok {
+			rbm.logger.Errorf("Tombstone contained object that is not an Endpoints %#v", obj)
+			return
+		}
+	}
 	revID := types.NamespacedName{ep.Namespace, ep.Labels[serving.RevisionLabelKey]}
-
 	rbm.logger.Debugf("Deleting endpoint %q", revID.String())
-	rbm.revisionWatchersMux.Lock()
-	defer rbm.revisionWatchersMux.Unlock()
-	rbm.deleteRevisionWatcher(revID)
+
+	rbm.latestEndpointsMux.Lock()
+	delete(rbm.latestEndpoints, revID)
+	rbm.latestEndpointsMux.Unlock()
+
+	rbm.workqueue.Add(revID)
+}
+
+// Run starts workers worker goroutines draining the endpoints workqueue,
+// blocking until stopCh is closed. It mirrors the standard client-go
+// controller idiom: newRevisionBackendsManager wires up informers and the
+// queue, Run starts the workers that drain it. workers <= 0 defaults to
+// runtime.NumCPU(). Callers should close stopCh no later than they cancel
+// the context passed to newRevisionBackendsManager, so a worker can't still
+// be draining the queue against revisionWatchers that have already stopped
+// reading their destsCh.
+func (rbm *revisionBackendsManager) Run(workers int, stopCh <-chan struct{}) {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			wait.Until(rbm.runWorker, time.Second, stopCh)
+		}()
+	}
+
+	<-stopCh
+	// Workers are parked in workqueue.Get(), which only unblocks on a new
+	// item or ShutDown(); we must call it here, before waiting for them to
+	// drain, or wg.Wait() below would block forever.
+	rbm.workqueue.ShutDown()
+	wg.Wait()
+}
+
+func (rbm *revisionBackendsManager) runWorker() {
+	for rbm.processNextWorkItem() {
+	}
+}
+
+// processNextWorkItem pops a single revision key off the workqueue and syncs
+// it, reporting whether the caller should keep calling it (false only once
+// the queue has been shut down). A panic while syncing is recovered so it
+// costs this one work item, not the worker goroutine.
+func (rbm *revisionBackendsManager) processNextWorkItem() (ok bool) {
+	ok = true
+	defer handleCrash(rbm.logger, "revisionBackendsManager worker", nil)
+
+	obj, shutdown := rbm.workqueue.Get()
+	if shutdown {
+		return false
+	}
+	defer rbm.workqueue.Done(obj)
+
+	revID, ok := obj.(types.NamespacedName)
+	if !ok {
+		rbm.workqueue.Forget(obj)
+		rbm.logger.Errorf("Expected types.NamespacedName in workqueue but got %#v", obj)
+		return true
+	}
+
+	if err := rbm.syncRevisionEndpoints(revID); err != nil {
+		rbm.workqueue.AddRateLimited(revID)
+		rbm.logger.Errorw("Error syncing endpoints for revision "+revID.String(), zap.Error(err))
+		return true
+	}
+
+	rbm.workqueue.Forget(revID)
+	return true
+}
+
+// syncRevisionEndpoints applies the latest cached Endpoints for revID to its
+// revisionWatcher, creating the watcher if needed, or tears the watcher down
+// if the Endpoints have been deleted.
+func (rbm *revisionBackendsManager) syncRevisionEndpoints(revID types.NamespacedName) error {
+	rbm.latestEndpointsMux.Lock()
+	endpoints, ok := rbm.latestEndpoints[revID]
+	rbm.latestEndpointsMux.Unlock()
+
+	if !ok {
+		rbm.revisionWatchersMux.Lock()
+		defer rbm.revisionWatchersMux.Unlock()
+		rbm.deleteRevisionWatcher(revID)
+		return nil
+	}
+
+	rw, err := rbm.getOrCreateRevisionWatcher(revID)
+	if err != nil {
+		return err
+	}
+	dests := endpointsToDests(endpoints, networking.ServicePortName(rw.protocol))
+	rbm.logger.Debugf("Updating Endpoints: %q (backends: %d)", revID.String(), len(dests))
+
+	// rw may have crashed (see runRevisionWatcher) and not been respawned
+	// yet, in which case nothing will ever read destsCh. Select on rw.stopped
+	// rather than sending unconditionally so that window surfaces as a
+	// requeue-able error instead of either panicking (destsCh is never
+	// closed, so a bare send can't panic on this path, but an unguarded send
+	// could still block this worker forever) or dropping the update.
+	select {
+	case rw.destsCh <- dests:
+		return nil
+	case <-rw.stopped:
+		return fmt.Errorf("revisionWatcher for %q stopped before its dests update could be delivered", revID.String())
+	}
 }
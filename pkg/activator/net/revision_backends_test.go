@@ -0,0 +1,398 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package net
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/sets"
+	corev1listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+
+	"knative.dev/serving/pkg/apis/networking"
+	"knative.dev/serving/pkg/apis/serving"
+)
+
+// fakeProber is a Prober whose answers are keyed by dest and that counts
+// how many times it was called, so tests can assert whether a probe cycle
+// actually re-probed or short-circuited.
+type fakeProber struct {
+	mu      sync.Mutex
+	healthy sets.String
+	calls   int
+}
+
+func newFakeProber(healthy ...string) *fakeProber {
+	return &fakeProber{healthy: sets.NewString(healthy...)}
+}
+
+func (p *fakeProber) Probe(ctx context.Context, dest string, proto networking.ProtocolType) (bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.calls++
+	return p.healthy.Has(dest), nil
+}
+
+func (p *fakeProber) callCount() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.calls
+}
+
+// newTestServiceLister returns a ServiceLister serving a single private
+// service for rev, so getK8sPrivateService's selector-based List finds it.
+func newTestServiceLister(t *testing.T, rev types.NamespacedName, clusterIP string) corev1listers.ServiceLister {
+	t.Helper()
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: rev.Namespace,
+			Name:      rev.Name + "-private",
+			Labels: map[string]string{
+				serving.RevisionLabelKey:  rev.Name,
+				networking.ServiceTypeKey: string(networking.ServiceTypePrivate),
+			},
+		},
+		Spec: corev1.ServiceSpec{
+			ClusterIP: clusterIP,
+			Ports: []corev1.ServicePort{{
+				Name: networking.ServicePortNameHTTP1,
+				Port: 8012,
+			}},
+		},
+	}
+	if err := indexer.Add(svc); err != nil {
+		t.Fatal(err)
+	}
+	return corev1listers.NewServiceLister(indexer)
+}
+
+func newTestRevisionWatcher(t *testing.T, prober Prober, serviceLister corev1listers.ServiceLister) (*revisionWatcher, chan revisionDestsUpdate) {
+	t.Helper()
+	rev := types.NamespacedName{Namespace: "ns", Name: "rev"}
+	updateCh := make(chan revisionDestsUpdate, 10)
+	destsCh := make(chan sets.String, 1)
+	rw := newRevisionWatcher(context.Background(), rev, networking.ProtocolHTTP1, updateCh, destsCh,
+		prober, serviceLister, zap.NewNop().Sugar(), probeFrequency, probeFrequencyCeiling, 0 /*jitter*/)
+	return rw, updateCh
+}
+
+// TestCheckDestsReprobesOnChurnAfterClusterIPHealthy verifies that once the
+// ClusterIP has been probed healthy, a change in the endpoint's backing
+// pods still triggers a fresh probe cycle instead of the short-circuit path
+// that applies when nothing has changed.
+func TestCheckDestsReprobesOnChurnAfterClusterIPHealthy(t *testing.T) {
+	const clusterIPDest = "10.0.0.100:8012"
+	prober := newFakeProber(clusterIPDest, "10.0.0.1:8012", "10.0.0.2:8012")
+	rw, _ := newTestRevisionWatcher(t, prober, newTestServiceLister(t, types.NamespacedName{Namespace: "ns", Name: "rev"}, "10.0.0.100"))
+
+	if changed, err := rw.checkDests(sets.NewString("10.0.0.1:8012")); err != nil || !changed {
+		t.Fatalf("first checkDests: changed=%v err=%v, want changed=true err=nil", changed, err)
+	}
+	if !rw.clusterIPHealthy {
+		t.Fatal("expected ClusterIP to be marked healthy after first checkDests")
+	}
+	callsAfterFirst := prober.callCount()
+
+	// Same dests again: clusterIP healthy and no pod churn, should short-circuit.
+	if changed, err := rw.checkDests(sets.NewString("10.0.0.1:8012")); err != nil || changed {
+		t.Fatalf("no-op checkDests: changed=%v err=%v, want changed=false err=nil", changed, err)
+	}
+	if prober.callCount() != callsAfterFirst {
+		t.Fatalf("no-op checkDests made %d new probe calls, want 0", prober.callCount()-callsAfterFirst)
+	}
+
+	// Pod churn while ClusterIP is still healthy must still trigger re-probing.
+	if changed, err := rw.checkDests(sets.NewString("10.0.0.1:8012", "10.0.0.2:8012")); err != nil || !changed {
+		t.Fatalf("churned checkDests: changed=%v err=%v, want changed=true err=nil", changed, err)
+	}
+	if prober.callCount() <= callsAfterFirst {
+		t.Fatal("expected pod churn to trigger additional probe calls")
+	}
+}
+
+// TestProbeBackoffTransitions verifies the adaptive backoff climbs on
+// successive no-op cycles, caps at its ceiling, and resets to the floor the
+// moment a cycle reports a change or an error.
+func TestProbeBackoffTransitions(t *testing.T) {
+	floor, ceiling := 100*time.Millisecond, 800*time.Millisecond
+	b := newProbeBackoff(floor, ceiling, 0 /*jitter*/)
+
+	if got := b.nextInterval(false, nil); got != 200*time.Millisecond {
+		t.Fatalf("1st no-op interval = %v, want %v", got, 200*time.Millisecond)
+	}
+	if got := b.nextInterval(false, nil); got != 400*time.Millisecond {
+		t.Fatalf("2nd no-op interval = %v, want %v", got, 400*time.Millisecond)
+	}
+	if got := b.nextInterval(false, nil); got != ceiling {
+		t.Fatalf("3rd no-op interval = %v, want ceiling %v", got, ceiling)
+	}
+	if got := b.nextInterval(false, nil); got != ceiling {
+		t.Fatalf("backoff exceeded ceiling: got %v, want %v", got, ceiling)
+	}
+	if got := b.nextInterval(true, nil); got != floor {
+		t.Fatalf("changed=true should reset to floor: got %v, want %v", got, floor)
+	}
+	if got := b.nextInterval(false, nil); got != 200*time.Millisecond {
+		t.Fatalf("interval after reset = %v, want %v", got, 200*time.Millisecond)
+	}
+	if got := b.nextInterval(false, context.Canceled); got != floor {
+		t.Fatalf("err should reset to floor: got %v, want %v", got, floor)
+	}
+}
+
+// TestRespawnRevisionWatcherPreservesLastDests verifies a respawned watcher
+// is seeded with the crashed watcher's last known dests and that repeated,
+// closely-spaced respawns back off exponentially rather than looping tight.
+func TestRespawnRevisionWatcherPreservesLastDests(t *testing.T) {
+	rev := types.NamespacedName{Namespace: "ns", Name: "rev"}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	prober := newFakeProber()
+	rbm := &revisionBackendsManager{
+		ctx:              ctx,
+		serviceLister:    newTestServiceLister(t, rev, "10.0.0.1"),
+		revisionWatchers: make(map[types.NamespacedName]*revisionWatcher),
+		updateCh:         make(chan revisionDestsUpdate, 10),
+		logger:           zap.NewNop().Sugar(),
+		probeFloor:       probeFrequency,
+		probeCeiling:     probeFrequencyCeiling,
+		probeJitter:      0,
+	}
+
+	crashed, _ := newTestRevisionWatcher(t, prober, rbm.serviceLister)
+	crashed.lastDests = sets.NewString("10.0.0.9")
+	rbm.revisionWatchers[rev] = crashed
+
+	rbm.respawnRevisionWatcher(crashed)
+
+	respawned := rbm.revisionWatchers[rev]
+	if respawned == crashed {
+		t.Fatal("expected respawnRevisionWatcher to install a new watcher")
+	}
+	if respawned.respawnAttempt != 1 {
+		t.Fatalf("respawnAttempt = %d, want 1", respawned.respawnAttempt)
+	}
+	select {
+	case dests := <-respawned.destsCh:
+		if !dests.Equal(sets.NewString("10.0.0.9")) {
+			t.Fatalf("respawned destsCh = %v, want %v", dests, crashed.lastDests)
+		}
+	default:
+		t.Fatal("expected respawned watcher's destsCh to carry the crashed watcher's last dests")
+	}
+
+	// A second respawn in quick succession should back off further, not
+	// reset, since the respawned watcher hasn't had time to run healthily.
+	rbm.respawnRevisionWatcher(respawned)
+	again := rbm.revisionWatchers[rev]
+	if again.respawnAttempt != 2 {
+		t.Fatalf("respawnAttempt after second crash = %d, want 2", again.respawnAttempt)
+	}
+	if respawnDelay(2) <= respawnDelay(1) {
+		t.Fatalf("respawnDelay should grow with attempt: delay(1)=%v delay(2)=%v", respawnDelay(1), respawnDelay(2))
+	}
+}
+
+// TestRunReturnsPromptlyAfterStopChClosed is a regression test for a
+// deadlock where Run would never return: workers parked in
+// workqueue.Get() only unblock on ShutDown(), so Run must call it before
+// wg.Wait(), not defer it to after.
+func TestRunReturnsPromptlyAfterStopChClosed(t *testing.T) {
+	rbm := &revisionBackendsManager{
+		workqueue: workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "test"),
+		logger:    zap.NewNop().Sugar(),
+	}
+
+	stopCh := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		rbm.Run(2, stopCh)
+		close(done)
+	}()
+
+	close(stopCh)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return within 5s of stopCh closing")
+	}
+}
+
+// panicOnceProber panics the first time it's probed and answers healthy
+// after that, so it can force exactly one respawn of its revisionWatcher.
+type panicOnceProber struct {
+	mu       sync.Mutex
+	panicked bool
+}
+
+func (p *panicOnceProber) Probe(ctx context.Context, dest string, proto networking.ProtocolType) (bool, error) {
+	p.mu.Lock()
+	already := p.panicked
+	p.panicked = true
+	p.mu.Unlock()
+	if !already {
+		panic("forced probe panic for test")
+	}
+	return true, nil
+}
+
+func testEndpoints(rev types.NamespacedName, ip string, port int32) *corev1.Endpoints {
+	return &corev1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Namespace: rev.Namespace, Name: rev.Name},
+		Subsets: []corev1.EndpointSubset{{
+			Addresses: []corev1.EndpointAddress{{IP: ip}},
+			Ports:     []corev1.EndpointPort{{Name: networking.ServicePortNameHTTP1, Port: port}},
+		}},
+	}
+}
+
+// TestSyncRevisionEndpointsSurvivesConcurrentWatcherCrash is a regression
+// test for a race where a revisionWatcher panicking mid-probe closed no
+// channel synchronized with syncRevisionEndpoints's send on destsCh: a
+// concurrent sync landing in the window between the panic and
+// respawnRevisionWatcher installing a replacement watcher had no signal
+// that nobody would ever read what it sent. It repeatedly calls
+// syncRevisionEndpoints against a watcher that's mid-crash-and-respawn and
+// requires that it never panics and eventually succeeds once the
+// replacement watcher is up and draining its destsCh.
+func TestSyncRevisionEndpointsSurvivesConcurrentWatcherCrash(t *testing.T) {
+	rev := types.NamespacedName{Namespace: "ns", Name: "rev"}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	rbm := &revisionBackendsManager{
+		ctx:              ctx,
+		serviceLister:    newTestServiceLister(t, rev, "10.0.0.1"),
+		revisionWatchers: make(map[types.NamespacedName]*revisionWatcher),
+		latestEndpoints:  map[types.NamespacedName]*corev1.Endpoints{rev: testEndpoints(rev, "10.0.0.1", 8012)},
+		updateCh:         make(chan revisionDestsUpdate, 100),
+		logger:           zap.NewNop().Sugar(),
+		probeFloor:       probeFrequency,
+		probeCeiling:     probeFrequencyCeiling,
+		probeJitter:      0,
+	}
+
+	destsCh := make(chan sets.String)
+	rw := newRevisionWatcher(ctx, rev, networking.ProtocolHTTP1, rbm.updateCh, destsCh,
+		&panicOnceProber{}, rbm.serviceLister, rbm.logger, rbm.probeFloor, rbm.probeCeiling, 0 /*jitter*/)
+	rbm.revisionWatchers[rev] = rw
+	go rbm.runRevisionWatcher(rw)
+
+	// The original watcher receives this first sync and then panics in its
+	// ClusterIP probe, so any later success is delivered to its replacement.
+	if err := rbm.syncRevisionEndpoints(rev); err != nil {
+		t.Fatalf("first syncRevisionEndpoints = %v, want nil", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	var lastErr error
+	for time.Now().Before(deadline) {
+		if lastErr = rbm.syncRevisionEndpoints(rev); lastErr == nil {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("syncRevisionEndpoints never succeeded after the forced crash/respawn; last error: %v", lastErr)
+}
+
+// churnProber always reports its dest unhealthy (so a revisionWatcher keeps
+// ticking at its probe backoff interval instead of ever settling into the
+// short-circuit path) and records when each ClusterIP probe happens.
+type churnProber struct {
+	mu            sync.Mutex
+	clusterIPDest string
+	probeTimes    []time.Time
+}
+
+func (p *churnProber) Probe(ctx context.Context, dest string, proto networking.ProtocolType) (bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if dest == p.clusterIPDest {
+		p.probeTimes = append(p.probeTimes, time.Now())
+	}
+	return false, nil
+}
+
+func (p *churnProber) times() []time.Time {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	out := make([]time.Time, len(p.probeTimes))
+	copy(out, p.probeTimes)
+	return out
+}
+
+// TestRunDrainsTimerBeforeResetAcrossChurn is a regression test for a
+// time.Timer misuse: run's probe-backoff timer was Reset without first
+// draining a fire that happened to race the destsCh branch of its select,
+// which left a stale fire in the channel for the next loop iteration to
+// consume immediately — probing right away regardless of the backoff
+// interval that was just computed. It drives pod churn faster than the
+// probe interval and asserts consecutive ClusterIP probes are never
+// spaced closer together than (floor - tolerance).
+func TestRunDrainsTimerBeforeResetAcrossChurn(t *testing.T) {
+	rev := types.NamespacedName{Namespace: "ns", Name: "rev"}
+	const clusterIPDest = "10.0.0.100:8012"
+	prober := &churnProber{clusterIPDest: clusterIPDest}
+	serviceLister := newTestServiceLister(t, rev, "10.0.0.100")
+
+	updateCh := make(chan revisionDestsUpdate, 100)
+	destsCh := make(chan sets.String)
+	const floor = 30 * time.Millisecond
+	rw := newRevisionWatcher(context.Background(), rev, networking.ProtocolHTTP1, updateCh, destsCh,
+		prober, serviceLister, zap.NewNop().Sugar(), floor, floor /*ceiling == floor*/, 0 /*jitter*/)
+
+	go rw.run()
+	defer rw.cancel()
+
+	// Drive churn faster than the backoff interval so destsCh sends race the
+	// timer firing.
+	stop := time.After(200 * time.Millisecond)
+	n := 0
+churn:
+	for {
+		select {
+		case <-stop:
+			break churn
+		case <-time.After(7 * time.Millisecond):
+			n++
+			destsCh <- sets.NewString(fmt.Sprintf("10.0.0.%d:8012", n%250+1))
+		}
+	}
+
+	times := prober.times()
+	if len(times) < 3 {
+		t.Fatalf("too few probes recorded (%d) to assert timing; test did not exercise the loop", len(times))
+	}
+	const tolerance = floor / 2
+	for i := 1; i < len(times); i++ {
+		if gap := times[i].Sub(times[i-1]); gap < tolerance {
+			t.Fatalf("probe %d fired only %v after the previous one (floor %v): a stale timer fire was not drained before Reset", i, gap, floor)
+		}
+	}
+}